@@ -71,9 +71,16 @@ func minTime(t1 time.Time, t2 time.Time) time.Time {
 	return t2
 }
 
+// keyEntry is a single authorized key along with the expiration time parsed
+// out of its Google-specific comment field, or the zero time if the key
+// never expires.
+type keyEntry struct {
+	key        string
+	expireTime time.Time
+}
+
 type userData struct {
-	keys               []string
-	earliestExpireTime time.Time
+	keys []keyEntry
 }
 
 type userMapping = map[string]userData
@@ -89,9 +96,9 @@ func desiredKeyMapping() userMapping {
 
 func addKeysFromMetadata(um userMapping, attributes attributesJSON) {
 	for _, line := range strings.Split(attributes.SSHKeys, "\n") {
-		splitLine := strings.SplitAfterN(line, ":", 2)
+		splitLine := strings.SplitN(line, ":", 2)
 		if len(splitLine) != 2 {
-			// TODO: bad key format
+			logger.With("op", "parse_ssh_key", "line", line).Warn("Malformed sshKeys metadata entry, missing username separator")
 			continue
 		}
 
@@ -99,64 +106,110 @@ func addKeysFromMetadata(um userMapping, attributes attributesJSON) {
 		key := splitLine[1]
 		expireTime := keyExpireTime(key)
 		if timeHasExpired(expireTime) {
-			// TODO: key expired
+			logger.With("op", "parse_ssh_key", "username", username, "expire_at", expireTime).Warn("Dropping expired SSH key")
 			continue
 		}
 
 		userData := um[username]
-		userData.keys = append(userData.keys, key)
-		userData.earliestExpireTime = minTime(userData.earliestExpireTime, expireTime)
+		userData.keys = append(userData.keys, keyEntry{key: key, expireTime: expireTime})
 		um[username] = userData
 	}
 }
 
+// sshKeyUsernames returns every username named in the sshKeys metadata,
+// regardless of whether their keys have expired. Unlike desiredKeyMapping,
+// this is what decides whether a user has actually disappeared from
+// metadata, since a momentarily expired key must not look the same as a
+// removed user to anything that destroys local state (e.g. deleting the
+// Windows account provisionUsers created for them).
+func sshKeyUsernames() map[string]bool {
+	usernames := map[string]bool{}
+	addUsernamesFromMetadata(usernames, newMetadata.Instance.Attributes)
+	if !blockProjectSSHKeys(newMetadata) {
+		addUsernamesFromMetadata(usernames, newMetadata.Project.Attributes)
+	}
+	return usernames
+}
+
+func addUsernamesFromMetadata(usernames map[string]bool, attributes attributesJSON) {
+	for _, line := range strings.Split(attributes.SSHKeys, "\n") {
+		splitLine := strings.SplitN(line, ":", 2)
+		if len(splitLine) != 2 {
+			continue
+		}
+		usernames[splitLine[0]] = true
+	}
+}
+
+// keyFingerprintForLogging returns key's SHA256 fingerprint for attaching to
+// log records, falling back to "unknown" for keys too malformed to hash.
+func keyFingerprintForLogging(key string) string {
+	fp, err := keyFingerprint(key)
+	if err != nil {
+		return "unknown"
+	}
+	return fp
+}
+
 // Uses Google-specific semantics of the OpenSSH public key format's comment
 // field to determine if an SSH key is past its expiration timestamp, and
 // therefore no longer to be trusted. This format is still subject to change.
 // Reliance on it in any way is at your own risk.
 func keyExpireTime(key string) time.Time {
-	splitKey := strings.SplitAfterN(key, " ", 4)
+	fields := logger.With("op", "parse_key_expiration", "key_fp", keyFingerprintForLogging(key))
+
+	splitKey := strings.SplitN(key, " ", 4)
 	if len(splitKey) != 4 {
-		// TODO: no json
+		fields.Debug("Key has no Google JSON comment, treating as non-expiring")
 		return time.Time{}
 	}
 	schema := splitKey[2]
 	jsonData := []byte(splitKey[3])
 
 	if schema != "google-ssh" {
-		// TODO: Inval schema
+		fields.Debug("Key comment schema %q is not google-ssh, treating as non-expiring", schema)
 		return time.Time{}
 	}
 
 	data := struct {
-		userName string
-		expireOn string
+		UserName string `json:"userName"`
+		ExpireOn string `json:"expireOn"`
 	}{}
 	if json.Unmarshal(jsonData, &data) != nil {
-		// TODO: Inval JSON
+		fields.Warn("Failed to parse google-ssh JSON comment")
 		return time.Time{}
 	}
 
-	expireTime, err := time.Parse("2006-01-02T15:04:05+0000", data.expireOn)
+	expireTime, err := time.Parse("2006-01-02T15:04:05+0000", data.ExpireOn)
 	if err != nil {
-		// TODO: Bad Date
+		fields.Warn("Failed to parse expireOn timestamp %q: %v", data.ExpireOn, err)
 		return time.Time{}
 	}
 	return expireTime
 }
 
 type userState struct {
-	authorizedKeysDir  string
-	mapping            userMapping
+	authorizedKeysDir string
+	mapping           userMapping
+	// earliestExpireTime is the next timestamp at which some currently
+	// applied key, for any user, expires. It drives sshMgr.timeout() so the
+	// agent re-syncs as soon as a key needs to be dropped, rather than
+	// waiting for the next metadata change.
 	earliestExpireTime time.Time
+
+	// caKeys and principals are the last-applied TrustedUserCAKeys and
+	// ssh-cert-authority-principals state, used to make syncTrustedUserCAKeys
+	// a no-op when metadata hasn't actually changed.
+	caKeys     []string
+	principals map[string][]string
 }
 
 func (us *userState) setupGoogleDirectory() error {
 	err := os.Mkdir(us.authorizedKeysDir, directoryPermissions)
-	if err == nil || os.IsExist(err) {
-		return nil
+	if err != nil && !os.IsExist(err) {
+		return err
 	}
-	return err
+	return fixAuthorizedKeysDirPermissions(us.authorizedKeysDir)
 }
 
 func (us *userState) usernamesToUpdate(desired userMapping) []string {
@@ -175,42 +228,60 @@ func (us *userState) usernamesToUpdate(desired userMapping) []string {
 }
 
 func (us *userState) updateUserData(username string, data userData) error {
+	log := logger.With("username", username, "op", "update_user_data")
 	filePath := filepath.Join(us.authorizedKeysDir, username)
 	if len(data.keys) == 0 {
 		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 		delete(us.mapping, username)
+		log.Debug("Removed authorized_keys, user has no remaining keys")
 		return nil
 	}
 
 	// Our file should have a comment indicating it's managed by Compute Engine.
 	contents := bytes.NewBuffer(nil)
 	contents.WriteString(authorizedKeysFileHeader)
-	for _, key := range data.keys {
-		contents.WriteString(key)
+	for _, entry := range data.keys {
+		contents.WriteString(entry.key)
 		contents.WriteByte('\n')
+		logger.With("username", username, "op", "update_user_data", "key_fp", keyFingerprintForLogging(entry.key), "expire_at", entry.expireTime).Debug("Applying key")
 	}
 	if err := ioutil.WriteFile(filePath, contents.Bytes(), filePermissions); err != nil {
 		return err
 	}
+	// Only record this user as applied once the ACLs are actually fixed: if
+	// this fails (e.g. the local account doesn't exist yet), us.mapping must
+	// still differ from desired so usernamesToUpdate keeps retrying on the
+	// next poll instead of leaving the file with inherited ACLs forever.
+	if err := fixAuthorizedKeysFilePermissions(filePath, username); err != nil {
+		return err
+	}
 	us.mapping[username] = data
-	return fixAuthorizedKeysFilePermissions(filePath)
+	return nil
 }
 
 func (us *userState) updateExpireTime() {
 	us.earliestExpireTime = time.Time{}
 	for _, data := range us.mapping {
-		us.earliestExpireTime = minTime(us.earliestExpireTime, data.earliestExpireTime)
+		for _, entry := range data.keys {
+			us.earliestExpireTime = minTime(us.earliestExpireTime, entry.expireTime)
+		}
 	}
 }
 
 type sshMgr struct{}
 
 func (m *sshMgr) diff() bool {
+	logger.SetDebug(strings.ToLower(newMetadata.Instance.Attributes.EnableDebugLogging) == "true")
+
 	return blockProjectSSHKeys(oldMetadata) != blockProjectSSHKeys(newMetadata) ||
 		oldMetadata.Instance.Attributes.SSHKeys != newMetadata.Instance.Attributes.SSHKeys ||
-		oldMetadata.Project.Attributes.SSHKeys != newMetadata.Project.Attributes.SSHKeys
+		oldMetadata.Project.Attributes.SSHKeys != newMetadata.Project.Attributes.SSHKeys ||
+		oldMetadata.Instance.Attributes.TrustedUserCAKeys != newMetadata.Instance.Attributes.TrustedUserCAKeys ||
+		oldMetadata.Project.Attributes.TrustedUserCAKeys != newMetadata.Project.Attributes.TrustedUserCAKeys ||
+		oldMetadata.Instance.Attributes.SSHCertAuthorityPrincipals != newMetadata.Instance.Attributes.SSHCertAuthorityPrincipals ||
+		oldMetadata.Project.Attributes.SSHCertAuthorityPrincipals != newMetadata.Project.Attributes.SSHCertAuthorityPrincipals
 }
 
 func (m *sshMgr) timeout() bool {
@@ -233,24 +304,48 @@ func (m *sshMgr) disabled() bool {
 		filesystemState.authorizedKeysDir = keysDir
 		filesystemState.mapping = userMapping{}
 		filesystemState.earliestExpireTime = time.Time{}
+		filesystemState.caKeys = nil
+		filesystemState.principals = nil
 	}
 	return false
 }
 
 func (m *sshMgr) set() error {
+	updateError := false
+
+	if err := filesystemState.syncTrustedUserCAKeys(desiredCAKeys(), desiredPrincipals()); err != nil {
+		logger.With("op", "sync_trusted_user_ca_keys").Error(err)
+		updateError = true
+	}
+
 	desired := desiredKeyMapping()
+	enableCreation := enableWindowsSSHUserCreation(newMetadata)
+	groups := sshUserGroups(newMetadata.Instance.Attributes)
+	if err := provisionUsers(&filesystemState, desired, sshKeyUsernames(), enableCreation, groups); err != nil {
+		logger.With("op", "provision_users").Error(err)
+		updateError = true
+	}
+
 	toUpdate := filesystemState.usernamesToUpdate(desired)
 	if len(toUpdate) == 0 {
 		logger.Info("No users need to have their authorized keys updated")
+		if updateError {
+			// TODO: Return some general error
+		}
 		return nil
 	}
 	filesystemState.setupGoogleDirectory()
 
-	updateError := false
 	for _, username := range toUpdate {
 		data := desired[username]
 		if err := filesystemState.updateUserData(username, data); err != nil {
-			// TODO: Log error
+			if _, ok := err.(*userNotFoundError); ok {
+				// The local account doesn't exist yet; skip it for now
+				// instead of failing the whole sync.
+				logger.Info("Skipping SSH keys for %q: %v", username, err)
+				continue
+			}
+			logger.With("username", username, "op", "update_user_data").Error(err)
 			updateError = true
 		}
 	}
@@ -260,5 +355,6 @@ func (m *sshMgr) set() error {
 		// TODO: Return some general error
 		return nil
 	}
+	reportAppliedKeys(&filesystemState)
 	return nil
 }
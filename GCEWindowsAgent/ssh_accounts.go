@@ -0,0 +1,164 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+)
+
+const (
+	agentCreatedAccountsFile = "google_compute_agent_accounts.json"
+	defaultSSHUserGroup      = "Remote Desktop Users"
+)
+
+// netUserAPI is the subset of Windows local-account management the agent
+// needs. It's an interface, rather than calling netapi32 directly, so tests
+// can exercise provisionUsers with an in-memory fake. The package itself
+// builds only for Windows: ssh.go and ssh_ca.go use userNotFoundError and
+// the ACL helpers that are defined only in ssh_windows.go.
+type netUserAPI interface {
+	userExists(username string) (bool, error)
+	addUser(username string, groups []string) error
+	deleteUser(username string) error
+}
+
+// netUsers is the netUserAPI used to provision accounts. It's declared here,
+// untagged, and tests replace it with a fake; the real Windows-backed
+// implementation is installed by an init in ssh_accounts_windows.go.
+var netUsers netUserAPI
+
+func enableWindowsSSHUserCreation(metadata *metadataJSON) bool {
+	return strings.ToLower(metadata.Instance.Attributes.EnableWindowsSSHUserCreation) == "true"
+}
+
+// sshUserGroups returns the local groups a newly created SSH user should be
+// added to: the Remote Desktop Users group so they can actually start a
+// session, plus an optional sudoers-equivalent group named in metadata.
+func sshUserGroups(attributes attributesJSON) []string {
+	groups := []string{defaultSSHUserGroup}
+	if group := strings.TrimSpace(attributes.WindowsSSHUserGroup); group != "" {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// agentAccounts is the sidecar file recording which local accounts the
+// agent itself created, so it can clean them up again without ever touching
+// an account it didn't create.
+type agentAccounts struct {
+	Usernames []string `json:"usernames"`
+}
+
+func agentAccountsPath(authorizedKeysDir string) string {
+	return filepath.Join(filepath.Dir(authorizedKeysDir), agentCreatedAccountsFile)
+}
+
+func loadAgentAccounts(path string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]bool{}, nil
+		}
+		return nil, err
+	}
+
+	var accounts agentAccounts
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, err
+	}
+	created := map[string]bool{}
+	for _, username := range accounts.Usernames {
+		created[username] = true
+	}
+	return created, nil
+}
+
+func saveAgentAccounts(path string, created map[string]bool) error {
+	var accounts agentAccounts
+	for username := range created {
+		accounts.Usernames = append(accounts.Usernames, username)
+	}
+	sort.Strings(accounts.Usernames)
+
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, filePermissions)
+}
+
+// provisionUsers makes sure every username in desired has a local Windows
+// account, creating one when enableCreation is set and no account exists,
+// and removes accounts the agent previously created for usernames that have
+// since disappeared from metadataUsernames entirely. desired is the
+// expiration-filtered mapping, so it's used to decide who needs an account
+// right now; metadataUsernames is the raw set of usernames still named in
+// sshKeys, so a momentarily expired key doesn't look like a removed user and
+// get its account (and profile) deleted out from under it. Accounts it
+// didn't create are never touched, even if they later vanish from metadata.
+func provisionUsers(us *userState, desired userMapping, metadataUsernames map[string]bool, enableCreation bool, groups []string) error {
+	path := agentAccountsPath(us.authorizedKeysDir)
+	created, err := loadAgentAccounts(path)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for username := range desired {
+		log := logger.With("username", username, "op", "provision_user")
+
+		exists, err := netUsers.userExists(username)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if exists || !enableCreation {
+			continue
+		}
+		if err := netUsers.addUser(username, groups); err != nil {
+			log.Error(err)
+			continue
+		}
+		log.Info("Created local account for SSH key user")
+		created[username] = true
+		changed = true
+	}
+
+	for username := range created {
+		if metadataUsernames[username] {
+			continue
+		}
+		log := logger.With("username", username, "op", "deprovision_user")
+		if err := netUsers.deleteUser(username); err != nil {
+			log.Error(err)
+			continue
+		}
+		log.Info("Removed agent-created local account, no longer in metadata")
+		delete(created, username)
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return saveAgentAccounts(path, created)
+}
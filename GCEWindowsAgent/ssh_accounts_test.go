@@ -0,0 +1,204 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeNetUserAPI is a netUserAPI that tracks accounts in memory, so
+// provisionUsers can be tested without touching real Windows accounts.
+type fakeNetUserAPI struct {
+	existing map[string]bool
+	added    map[string][]string
+	deleted  map[string]bool
+}
+
+func newFakeNetUserAPI(existing ...string) *fakeNetUserAPI {
+	f := &fakeNetUserAPI{
+		existing: map[string]bool{},
+		added:    map[string][]string{},
+		deleted:  map[string]bool{},
+	}
+	for _, username := range existing {
+		f.existing[username] = true
+	}
+	return f
+}
+
+func (f *fakeNetUserAPI) userExists(username string) (bool, error) {
+	return f.existing[username], nil
+}
+
+func (f *fakeNetUserAPI) addUser(username string, groups []string) error {
+	f.existing[username] = true
+	f.added[username] = groups
+	return nil
+}
+
+func (f *fakeNetUserAPI) deleteUser(username string) error {
+	delete(f.existing, username)
+	f.deleted[username] = true
+	return nil
+}
+
+func withFakeNetUsers(t *testing.T, fake *fakeNetUserAPI) {
+	t.Helper()
+	old := netUsers
+	netUsers = fake
+	t.Cleanup(func() { netUsers = old })
+}
+
+// usernameSet builds the metadataUsernames argument for tests that aren't
+// exercising the expired-key-vs-removed-user distinction: every username in
+// desired is still named in metadata.
+func usernameSet(desired userMapping) map[string]bool {
+	usernames := map[string]bool{}
+	for username := range desired {
+		usernames[username] = true
+	}
+	return usernames
+}
+
+func newTestUserState(t *testing.T) *userState {
+	t.Helper()
+	dir := t.TempDir()
+	authorizedKeysDir := filepath.Join(dir, googleSSHSubDirectory)
+	if err := os.Mkdir(authorizedKeysDir, directoryPermissions); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	return &userState{authorizedKeysDir: authorizedKeysDir, mapping: userMapping{}}
+}
+
+func TestProvisionUsersCreatesMissingAccount(t *testing.T) {
+	fake := newFakeNetUserAPI()
+	withFakeNetUsers(t, fake)
+	us := newTestUserState(t)
+
+	desired := userMapping{"alice": userData{}}
+	if err := provisionUsers(us, desired, usernameSet(desired), true, []string{defaultSSHUserGroup}); err != nil {
+		t.Fatalf("provisionUsers: %v", err)
+	}
+
+	if !fake.existing["alice"] {
+		t.Errorf("expected alice to be created")
+	}
+	if groups := fake.added["alice"]; len(groups) != 1 || groups[0] != defaultSSHUserGroup {
+		t.Errorf("expected alice added to %v, got %v", defaultSSHUserGroup, groups)
+	}
+
+	created, err := loadAgentAccounts(agentAccountsPath(us.authorizedKeysDir))
+	if err != nil {
+		t.Fatalf("loadAgentAccounts: %v", err)
+	}
+	if !created["alice"] {
+		t.Errorf("expected alice recorded as agent-created")
+	}
+}
+
+func TestProvisionUsersSkipsCreationWhenDisabled(t *testing.T) {
+	fake := newFakeNetUserAPI()
+	withFakeNetUsers(t, fake)
+	us := newTestUserState(t)
+
+	desired := userMapping{"alice": userData{}}
+	if err := provisionUsers(us, desired, usernameSet(desired), false, []string{defaultSSHUserGroup}); err != nil {
+		t.Fatalf("provisionUsers: %v", err)
+	}
+
+	if fake.existing["alice"] {
+		t.Errorf("expected alice not to be created when creation is disabled")
+	}
+}
+
+func TestProvisionUsersLeavesPreexistingAccountAlone(t *testing.T) {
+	fake := newFakeNetUserAPI("alice")
+	withFakeNetUsers(t, fake)
+	us := newTestUserState(t)
+
+	desired := userMapping{"alice": userData{}}
+	if err := provisionUsers(us, desired, usernameSet(desired), true, []string{defaultSSHUserGroup}); err != nil {
+		t.Fatalf("provisionUsers: %v", err)
+	}
+	if _, ok := fake.added["alice"]; ok {
+		t.Errorf("expected provisionUsers not to recreate a preexisting account")
+	}
+
+	// alice disappears from metadata; since the agent never created her
+	// account, it must not be deleted.
+	if err := provisionUsers(us, userMapping{}, map[string]bool{}, true, []string{defaultSSHUserGroup}); err != nil {
+		t.Fatalf("provisionUsers: %v", err)
+	}
+	if !fake.existing["alice"] {
+		t.Errorf("expected preexisting account alice not to be removed")
+	}
+	if fake.deleted["alice"] {
+		t.Errorf("expected preexisting account alice not to be deleted")
+	}
+}
+
+func TestProvisionUsersRemovesAgentCreatedAccountNoLongerDesired(t *testing.T) {
+	fake := newFakeNetUserAPI()
+	withFakeNetUsers(t, fake)
+	us := newTestUserState(t)
+
+	if err := provisionUsers(us, userMapping{"bob": userData{}}, map[string]bool{"bob": true}, true, []string{defaultSSHUserGroup}); err != nil {
+		t.Fatalf("provisionUsers: %v", err)
+	}
+	if err := provisionUsers(us, userMapping{}, map[string]bool{}, true, []string{defaultSSHUserGroup}); err != nil {
+		t.Fatalf("provisionUsers: %v", err)
+	}
+
+	if fake.existing["bob"] {
+		t.Errorf("expected agent-created account bob to be removed once no longer desired")
+	}
+	if !fake.deleted["bob"] {
+		t.Errorf("expected bob to have been deleted via netUsers.deleteUser")
+	}
+
+	created, err := loadAgentAccounts(agentAccountsPath(us.authorizedKeysDir))
+	if err != nil {
+		t.Fatalf("loadAgentAccounts: %v", err)
+	}
+	if created["bob"] {
+		t.Errorf("expected bob removed from the sidecar file")
+	}
+}
+
+func TestProvisionUsersKeepsAccountWhenOnlyKeyMomentarilyExpired(t *testing.T) {
+	fake := newFakeNetUserAPI()
+	withFakeNetUsers(t, fake)
+	us := newTestUserState(t)
+
+	if err := provisionUsers(us, userMapping{"bob": userData{}}, map[string]bool{"bob": true}, true, []string{defaultSSHUserGroup}); err != nil {
+		t.Fatalf("provisionUsers: %v", err)
+	}
+
+	// bob's only key has expired, so desiredKeyMapping no longer has an entry
+	// for him, but he's still named in sshKeys metadata; his account must
+	// survive until he's actually removed from metadata.
+	if err := provisionUsers(us, userMapping{}, map[string]bool{"bob": true}, true, []string{defaultSSHUserGroup}); err != nil {
+		t.Fatalf("provisionUsers: %v", err)
+	}
+
+	if !fake.existing["bob"] {
+		t.Errorf("expected bob's account to survive a momentarily expired key")
+	}
+	if fake.deleted["bob"] {
+		t.Errorf("expected bob not to have been deleted while still named in metadata")
+	}
+}
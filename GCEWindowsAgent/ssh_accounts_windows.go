@@ -0,0 +1,149 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modNetapi32                 = windows.NewLazySystemDLL("netapi32.dll")
+	procNetUserGetInfo          = modNetapi32.NewProc("NetUserGetInfo")
+	procNetUserAdd              = modNetapi32.NewProc("NetUserAdd")
+	procNetUserDel              = modNetapi32.NewProc("NetUserDel")
+	procNetLocalGroupAddMembers = modNetapi32.NewProc("NetLocalGroupAddMembers")
+	procNetApiBufferFree        = modNetapi32.NewProc("NetApiBufferFree")
+)
+
+// Subset of the Win32 NET_API_STATUS / NERR_ values we care about. See
+// lmerr.h / lmaccess.h.
+const (
+	nerrSuccess      = 0
+	nerrUserNotFound = 2221
+
+	ufScript        = 0x0001
+	ufPasswdNotreqd = 0x0020
+	ufNormalAccount = 0x0200
+
+	userPrivUser = 1
+
+	localGroupNameInfoLevel = 3
+)
+
+// userInfo1 mirrors the Win32 USER_INFO_1 structure consumed by NetUserAdd.
+type userInfo1 struct {
+	Name        *uint16
+	Password    *uint16
+	PasswordAge uint32
+	Priv        uint32
+	HomeDir     *uint16
+	Comment     *uint16
+	Flags       uint32
+	ScriptPath  *uint16
+}
+
+// localGroupMembersInfo3 mirrors LOCALGROUP_MEMBERS_INFO_3, which identifies
+// a member by name rather than SID.
+type localGroupMembersInfo3 struct {
+	DomainAndName *uint16
+}
+
+type windowsNetUserAPI struct{}
+
+func (windowsNetUserAPI) userExists(username string) (bool, error) {
+	namePtr, err := windows.UTF16PtrFromString(username)
+	if err != nil {
+		return false, err
+	}
+
+	var buf uintptr
+	r, _, _ := procNetUserGetInfo.Call(0, uintptr(unsafe.Pointer(namePtr)), 0, uintptr(unsafe.Pointer(&buf)))
+	if buf != 0 {
+		procNetApiBufferFree.Call(buf)
+	}
+	switch r {
+	case nerrSuccess:
+		return true, nil
+	case nerrUserNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("NetUserGetInfo(%q): error %d", username, r)
+	}
+}
+
+func (windowsNetUserAPI) addUser(username string, groups []string) error {
+	namePtr, err := windows.UTF16PtrFromString(username)
+	if err != nil {
+		return err
+	}
+
+	info := userInfo1{
+		Name:  namePtr,
+		Priv:  userPrivUser,
+		Flags: ufScript | ufPasswdNotreqd | ufNormalAccount,
+	}
+	var parmErr uint32
+	if r, _, _ := procNetUserAdd.Call(0, 1, uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&parmErr))); r != nerrSuccess {
+		return fmt.Errorf("NetUserAdd(%q): error %d (bad parameter %d)", username, r, parmErr)
+	}
+
+	for _, group := range groups {
+		if err := addToLocalGroup(username, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addToLocalGroup(username, group string) error {
+	groupPtr, err := windows.UTF16PtrFromString(group)
+	if err != nil {
+		return err
+	}
+	namePtr, err := windows.UTF16PtrFromString(username)
+	if err != nil {
+		return err
+	}
+
+	member := localGroupMembersInfo3{DomainAndName: namePtr}
+	r, _, _ := procNetLocalGroupAddMembers.Call(
+		0,
+		uintptr(unsafe.Pointer(groupPtr)),
+		localGroupNameInfoLevel,
+		uintptr(unsafe.Pointer(&member)),
+		1)
+	if r != nerrSuccess {
+		return fmt.Errorf("NetLocalGroupAddMembers(%q, %q): error %d", group, username, r)
+	}
+	return nil
+}
+
+func (windowsNetUserAPI) deleteUser(username string) error {
+	namePtr, err := windows.UTF16PtrFromString(username)
+	if err != nil {
+		return err
+	}
+	if r, _, _ := procNetUserDel.Call(0, uintptr(unsafe.Pointer(namePtr))); r != nerrSuccess {
+		return fmt.Errorf("NetUserDel(%q): error %d", username, r)
+	}
+	return nil
+}
+
+func init() {
+	netUsers = windowsNetUserAPI{}
+}
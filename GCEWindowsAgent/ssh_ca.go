@@ -0,0 +1,271 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+)
+
+const (
+	googleTrustedUserCAKeysFile = "google_compute_trusted_user_ca_keys"
+	googlePrincipalsSubDir      = "google_compute_authorized_principals"
+	sshdConfigFile              = "sshd_config"
+	sshdConfigFilePermissions   = 0644
+
+	sshdConfigBeginMarker = "# Added by Google Compute Engine TrustedUserCAKeys"
+	sshdConfigEndMarker   = "# End Google Compute Engine TrustedUserCAKeys"
+)
+
+func splitNonEmptyLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func desiredCAKeys() []string {
+	var keys []string
+	keys = append(keys, splitNonEmptyLines(newMetadata.Instance.Attributes.TrustedUserCAKeys)...)
+	if !blockProjectSSHKeys(newMetadata) {
+		keys = append(keys, splitNonEmptyLines(newMetadata.Project.Attributes.TrustedUserCAKeys)...)
+	}
+	return keys
+}
+
+func desiredPrincipals() map[string][]string {
+	pm := map[string][]string{}
+	addPrincipalsFromMetadata(pm, newMetadata.Instance.Attributes)
+	if !blockProjectSSHKeys(newMetadata) {
+		addPrincipalsFromMetadata(pm, newMetadata.Project.Attributes)
+	}
+	return pm
+}
+
+// addPrincipalsFromMetadata parses lines of the form
+// "username:principal1,principal2" out of the ssh-cert-authority-principals
+// attribute and records, per user, which certificate principals to accept.
+func addPrincipalsFromMetadata(pm map[string][]string, attributes attributesJSON) {
+	for _, line := range strings.Split(attributes.SSHCertAuthorityPrincipals, "\n") {
+		splitLine := strings.SplitN(line, ":", 2)
+		if len(splitLine) != 2 {
+			logger.With("op", "parse_principals", "line", line).Warn("Malformed ssh-cert-authority-principals metadata entry, missing username separator")
+			continue
+		}
+		username := splitLine[0]
+		pm[username] = append(pm[username], strings.Split(splitLine[1], ",")...)
+	}
+}
+
+func (us *userState) trustedUserCAKeysPath() string {
+	return filepath.Join(filepath.Dir(us.authorizedKeysDir), googleTrustedUserCAKeysFile)
+}
+
+func (us *userState) principalsDir() string {
+	return filepath.Join(filepath.Dir(us.authorizedKeysDir), googlePrincipalsSubDir)
+}
+
+func (us *userState) sshdConfigPath() string {
+	return filepath.Join(filepath.Dir(us.authorizedKeysDir), sshdConfigFile)
+}
+
+// caKeysEqual and principalsEqual compare against the last-applied state,
+// treating a nil and an empty slice/map as equal so that an unused feature
+// (no TrustedUserCAKeys/principals in metadata, ever) is a true no-op instead
+// of re-running the removal path on every poll.
+func caKeysEqual(a, b []string) bool {
+	return (len(a) == 0 && len(b) == 0) || reflect.DeepEqual(a, b)
+}
+
+func principalsEqual(a, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for username, names := range a {
+		if !reflect.DeepEqual(names, b[username]) {
+			return false
+		}
+	}
+	return true
+}
+
+// syncTrustedUserCAKeys reconciles the on-disk TrustedUserCAKeys file,
+// per-user AuthorizedPrincipalsFile entries, and the Google-managed block of
+// sshd_config with the desired state from metadata. It is idempotent: if
+// nothing changed since the last call it does no work.
+func (us *userState) syncTrustedUserCAKeys(keys []string, principals map[string][]string) error {
+	if caKeysEqual(keys, us.caKeys) && principalsEqual(principals, us.principals) {
+		return nil
+	}
+
+	if len(keys) == 0 {
+		if err := os.Remove(us.trustedUserCAKeysPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.RemoveAll(us.principalsDir()); err != nil {
+			return err
+		}
+		if err := us.updateSSHDConfigBlock("", false); err != nil {
+			return err
+		}
+		us.caKeys = nil
+		us.principals = nil
+		return nil
+	}
+
+	contents := bytes.NewBuffer(nil)
+	contents.WriteString(authorizedKeysFileHeader)
+	for _, key := range keys {
+		contents.WriteString(key)
+		contents.WriteByte('\n')
+	}
+	caKeysPath := us.trustedUserCAKeysPath()
+	if err := ioutil.WriteFile(caKeysPath, contents.Bytes(), filePermissions); err != nil {
+		return err
+	}
+	if err := fixSystemManagedFilePermissions(caKeysPath); err != nil {
+		return err
+	}
+
+	havePrincipals := len(principals) > 0
+	if havePrincipals {
+		principalsDir := us.principalsDir()
+		if err := os.Mkdir(principalsDir, directoryPermissions); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := fixSystemManagedFilePermissions(principalsDir); err != nil {
+			return err
+		}
+		// Drop files of users no longer named in metadata.
+		existing, err := ioutil.ReadDir(principalsDir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range existing {
+			if _, ok := principals[fi.Name()]; !ok {
+				if err := os.Remove(filepath.Join(principalsDir, fi.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		for username, names := range principals {
+			principalsPath := filepath.Join(principalsDir, username)
+			if err := ioutil.WriteFile(principalsPath, []byte(strings.Join(names, "\n")+"\n"), filePermissions); err != nil {
+				return err
+			}
+			if err := fixAuthorizedKeysFilePermissions(principalsPath, username); err != nil {
+				if _, ok := err.(*userNotFoundError); ok {
+					// Account doesn't exist locally yet; the file is still
+					// written so it's ready once the user shows up.
+					continue
+				}
+				return err
+			}
+		}
+	} else {
+		if err := os.RemoveAll(us.principalsDir()); err != nil {
+			return err
+		}
+	}
+
+	if err := us.updateSSHDConfigBlock(caKeysPath, havePrincipals); err != nil {
+		return err
+	}
+	us.caKeys = keys
+	us.principals = principals
+	return nil
+}
+
+// updateSSHDConfigBlock rewrites the Google-managed block of sshd_config,
+// replacing whatever was there before. Passing caKeysPath == "" removes the
+// block entirely, which is what happens when trusted-user-ca-keys is no
+// longer present in metadata.
+func (us *userState) updateSSHDConfigBlock(caKeysPath string, havePrincipals bool) error {
+	var block []string
+	if caKeysPath != "" {
+		block = append(block, "TrustedUserCAKeys "+caKeysPath)
+		if havePrincipals {
+			block = append(block, "AuthorizedPrincipalsFile "+filepath.Join(us.principalsDir(), "%u"))
+		}
+	}
+	return rewriteManagedBlock(us.sshdConfigPath(), sshdConfigBeginMarker, sshdConfigEndMarker, block)
+}
+
+// rewriteManagedBlock replaces the lines between beginMarker and endMarker in
+// path with newBlock, preserving everything else in the file untouched. An
+// empty newBlock removes the markers and their contents entirely.
+func rewriteManagedBlock(path, beginMarker, endMarker string, newBlock []string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	fileExisted := err == nil
+	var lines []string
+	if fileExisted {
+		lines = strings.Split(string(data), "\n")
+	}
+
+	var out []string
+	inBlock := false
+	blockAt := -1
+	for _, line := range lines {
+		switch strings.TrimSpace(line) {
+		case beginMarker:
+			inBlock = true
+			if blockAt < 0 {
+				blockAt = len(out)
+			}
+			continue
+		case endMarker:
+			inBlock = false
+			continue
+		}
+		if !inBlock {
+			out = append(out, line)
+		}
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+
+	if len(newBlock) == 0 && len(out) == 0 && !fileExisted {
+		// Nothing to remove and nothing existed before; don't materialize a
+		// stray empty sshd_config.
+		return nil
+	}
+
+	if len(newBlock) > 0 {
+		// Put the block back where the old one was, or at the end if there
+		// was none.
+		if blockAt < 0 || blockAt > len(out) {
+			blockAt = len(out)
+		}
+		managed := append([]string{beginMarker}, newBlock...)
+		managed = append(managed, endMarker)
+		out = append(out[:blockAt], append(managed, out[blockAt:]...)...)
+	}
+
+	return ioutil.WriteFile(path, []byte(strings.Join(out, "\n")+"\n"), sshdConfigFilePermissions)
+}
@@ -0,0 +1,152 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+)
+
+const (
+	guestAttributesSSHKeysPath = "google-compute-sshkeys/applied"
+	guestAttributesURL         = "http://metadata.google.internal/computeMetadata/v1/instance/guest-attributes/"
+)
+
+// appliedSSHKey is a single key as reported to Guest Attributes: enough for
+// external orchestration to confirm a specific key landed, without leaking
+// the key material itself.
+type appliedSSHKey struct {
+	Fingerprint string `json:"fingerprint"`
+	ExpireTime  string `json:"expireTime,omitempty"`
+}
+
+type appliedSSHKeysReport struct {
+	Generation int64                      `json:"generation"`
+	Timestamp  string                     `json:"timestamp"`
+	Users      map[string][]appliedSSHKey `json:"users"`
+}
+
+var guestAttributesState struct {
+	generation  int64
+	lastUsers   map[string][]appliedSSHKey
+	initialized bool
+}
+
+// enableGuestAttributesSSHReport reports whether applied SSH keys should be
+// published to Guest Attributes. The feature is on by default; set
+// enable-guest-attributes-ssh-report=false in metadata to opt out.
+func enableGuestAttributesSSHReport(metadata *metadataJSON) bool {
+	return strings.ToLower(metadata.Instance.Attributes.EnableGuestAttributesSSHReport) != "false"
+}
+
+// keyFingerprint reproduces the SHA256 fingerprint format ssh-keygen -l
+// prints, e.g. "SHA256:base64(sha256(key blob))" with no padding.
+func keyFingerprint(key string) (string, error) {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("malformed key: %q", key)
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", fmt.Errorf("decoding key blob: %v", err)
+	}
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+func usersAppliedKeys(mapping userMapping) map[string][]appliedSSHKey {
+	users := map[string][]appliedSSHKey{}
+	for username, data := range mapping {
+		var keys []appliedSSHKey
+		for _, entry := range data.keys {
+			fp, err := keyFingerprint(entry.key)
+			if err != nil {
+				logger.Error(err)
+				continue
+			}
+			applied := appliedSSHKey{Fingerprint: fp}
+			if !entry.expireTime.IsZero() {
+				applied.ExpireTime = entry.expireTime.UTC().Format(time.RFC3339)
+			}
+			keys = append(keys, applied)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Fingerprint < keys[j].Fingerprint })
+		users[username] = keys
+	}
+	return users
+}
+
+// reportAppliedKeys publishes a best-effort summary of us.mapping to Guest
+// Attributes so external orchestration can confirm a key landed without
+// racing the metadata poller. It is debounced: unchanged state produces no
+// write, and any failure is logged rather than propagated.
+func reportAppliedKeys(us *userState) {
+	if !enableGuestAttributesSSHReport(newMetadata) {
+		return
+	}
+
+	users := usersAppliedKeys(us.mapping)
+	if guestAttributesState.initialized && reflect.DeepEqual(users, guestAttributesState.lastUsers) {
+		return
+	}
+
+	generation := guestAttributesState.generation + 1
+	report := appliedSSHKeysReport{
+		Generation: generation,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Users:      users,
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if err := putGuestAttribute(guestAttributesSSHKeysPath, body); err != nil {
+		logger.Error(err)
+		return
+	}
+
+	guestAttributesState.generation = generation
+	guestAttributesState.lastUsers = users
+	guestAttributesState.initialized = true
+}
+
+func putGuestAttribute(path string, value []byte) error {
+	req, err := http.NewRequest(http.MethodPut, guestAttributesURL+path, bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("guest-attributes PUT %v: %v", path, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func googleKey(expireTime time.Time) string {
+	if expireTime.IsZero() {
+		return "ssh-rsa AAAA"
+	}
+	return fmt.Sprintf(`ssh-rsa AAAA google-ssh {"expireOn":"%s"}`, expireTime.UTC().Format("2006-01-02T15:04:05+0000"))
+}
+
+func TestAddKeysFromMetadataMixedExpiration(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	attrs := attributesJSON{
+		SSHKeys: "alice:" + googleKey(past) + "\n" +
+			"alice:" + googleKey(future) + "\n" +
+			"alice:" + googleKey(time.Time{}),
+	}
+
+	um := userMapping{}
+	addKeysFromMetadata(um, attrs)
+
+	data, ok := um["alice"]
+	if !ok {
+		t.Fatalf("expected user alice in mapping")
+	}
+	if len(data.keys) != 2 {
+		t.Fatalf("expected alice's expired key to be dropped, got %d keys", len(data.keys))
+	}
+	for _, entry := range data.keys {
+		if timeHasExpired(entry.expireTime) {
+			t.Errorf("found expired entry that should have been filtered: %+v", entry)
+		}
+	}
+}
+
+func TestUsernamesToUpdateIgnoresAlreadyExpiredKey(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+
+	current := userMapping{
+		"alice": userData{keys: []keyEntry{{key: "ssh-rsa AAAA", expireTime: future}}},
+	}
+	us := &userState{mapping: current}
+
+	// Metadata is unchanged; alice's expired key was already filtered out of
+	// the desired mapping on a previous poll, so nothing about her should be
+	// flagged now.
+	desired := userMapping{
+		"alice": userData{keys: []keyEntry{{key: "ssh-rsa AAAA", expireTime: future}}},
+	}
+
+	if toUpdate := us.usernamesToUpdate(desired); len(toUpdate) != 0 {
+		t.Errorf("expected no users to update, got %v", toUpdate)
+	}
+}
+
+func TestUpdateExpireTimeUsesMinOverLiveEntries(t *testing.T) {
+	soon := time.Now().Add(time.Minute)
+	later := time.Now().Add(time.Hour)
+
+	us := &userState{
+		mapping: userMapping{
+			"alice": userData{keys: []keyEntry{{key: "k1", expireTime: later}}},
+			"bob":   userData{keys: []keyEntry{{key: "k2", expireTime: soon}, {key: "k3", expireTime: later}}},
+		},
+	}
+	us.updateExpireTime()
+
+	if !us.earliestExpireTime.Equal(soon) {
+		t.Errorf("expected earliestExpireTime %v, got %v", soon, us.earliestExpireTime)
+	}
+}
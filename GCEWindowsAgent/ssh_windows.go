@@ -15,7 +15,9 @@
 package main
 
 import (
+	"fmt"
 	"path/filepath"
+	"sync"
 
 	"golang.org/x/sys/windows"
 )
@@ -30,7 +32,149 @@ func sshDataDir() (string, error) {
 	return filepath.Join(programData, "ssh"), nil
 }
 
-func fixAuthorizedKeysFilePermissions(path string) error {
-	// TODO implement
-	return nil
+// userNotFoundError is returned by lookupUserSID whenever an account name
+// can't be resolved to a SID. Every lookup failure is reported this way, so a
+// caller that type-asserts for it treats an LSA failure the same as a local
+// account that doesn't exist yet.
+type userNotFoundError struct {
+	username string
+	err      error
+}
+
+func (e *userNotFoundError) Error() string {
+	return fmt.Sprintf("user %q not found: %v", e.username, e.err)
+}
+
+func (e *userNotFoundError) Unwrap() error {
+	return e.err
+}
+
+var (
+	sidCacheMu sync.Mutex
+	sidCache   = map[string]*windows.SID{}
+)
+
+// lookupUserSID resolves username to a SID, caching the result so repeated
+// calls during a sync don't each incur an LSA RPC. Returns a
+// *userNotFoundError if the lookup fails for any reason.
+func lookupUserSID(username string) (*windows.SID, error) {
+	sidCacheMu.Lock()
+	defer sidCacheMu.Unlock()
+
+	if sid, ok := sidCache[username]; ok {
+		return sid, nil
+	}
+
+	sid, _, _, err := windows.LookupSID("", username)
+	if err != nil {
+		return nil, &userNotFoundError{username: username, err: err}
+	}
+	sidCache[username] = sid
+	return sid, nil
+}
+
+// securableDACL builds a protected, non-inherited DACL granting Read+Execute
+// to owner, and Full Control to SYSTEM and BUILTIN\Administrators.
+func securableDACL(owner *windows.SID) (*windows.ACL, error) {
+	system, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+	if err != nil {
+		return nil, fmt.Errorf("creating SYSTEM sid: %v", err)
+	}
+	admins, err := windows.CreateWellKnownSid(windows.WinBuiltinAdministratorsSid)
+	if err != nil {
+		return nil, fmt.Errorf("creating Administrators sid: %v", err)
+	}
+
+	entries := []windows.EXPLICIT_ACCESS{
+		explicitAccess(owner, windows.GENERIC_READ|windows.GENERIC_EXECUTE),
+		explicitAccess(system, windows.GENERIC_ALL),
+		explicitAccess(admins, windows.GENERIC_ALL),
+	}
+	return windows.SetEntriesInAcl(entries, nil)
+}
+
+func explicitAccess(sid *windows.SID, perm windows.ACCESS_MASK) windows.EXPLICIT_ACCESS {
+	return windows.EXPLICIT_ACCESS{
+		AccessPermissions: perm,
+		AccessMode:        windows.GRANT_ACCESS,
+		Inheritance:       windows.NO_INHERITANCE,
+		Trustee: windows.TRUSTEE{
+			TrusteeForm:  windows.TRUSTEE_IS_SID,
+			TrusteeType:  windows.TRUSTEE_IS_USER,
+			TrusteeValue: windows.TrusteeValueFromSID(sid),
+		},
+	}
+}
+
+// securePathForUser rewrites path's owner and DACL so that only owner,
+// SYSTEM, and BUILTIN\Administrators can access it, disabling inheritance
+// from the parent directory. sshd refuses to use authorized_keys files that
+// are writable by anyone else.
+func securePathForUser(path string, owner *windows.SID) error {
+	dacl, err := securableDACL(owner)
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(
+		path,
+		windows.SE_FILE_OBJECT,
+		windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION,
+		owner,
+		nil,
+		dacl,
+		nil)
+}
+
+func fixAuthorizedKeysFilePermissions(path string, username string) error {
+	sid, err := lookupUserSID(username)
+	if err != nil {
+		return err
+	}
+	return securePathForUser(path, sid)
+}
+
+// systemAdminsDACL builds a protected DACL granting Full Control to SYSTEM
+// and BUILTIN\Administrators only, with no entry for any other principal.
+func systemAdminsDACL() (*windows.ACL, error) {
+	system, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+	if err != nil {
+		return nil, fmt.Errorf("creating SYSTEM sid: %v", err)
+	}
+	admins, err := windows.CreateWellKnownSid(windows.WinBuiltinAdministratorsSid)
+	if err != nil {
+		return nil, fmt.Errorf("creating Administrators sid: %v", err)
+	}
+
+	entries := []windows.EXPLICIT_ACCESS{
+		explicitAccess(system, windows.GENERIC_ALL),
+		explicitAccess(admins, windows.GENERIC_ALL),
+	}
+	return windows.SetEntriesInAcl(entries, nil)
+}
+
+// fixSystemManagedFilePermissions locks path down to SYSTEM and
+// BUILTIN\Administrators, disabling inheritance. Used for files and
+// directories that sshd reads as itself (running as SYSTEM) rather than
+// impersonating a specific user, such as google_compute_authorized_keys and
+// google_compute_trusted_user_ca_keys.
+func fixSystemManagedFilePermissions(path string) error {
+	dacl, err := systemAdminsDACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(
+		path,
+		windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION,
+		nil,
+		nil,
+		dacl,
+		nil)
+}
+
+// fixAuthorizedKeysDirPermissions locks down the google_compute_authorized_keys
+// directory itself to SYSTEM and BUILTIN\Administrators, so it can't be used
+// to plant a file for another user before per-file ACLs are applied.
+func fixAuthorizedKeysDirPermissions(path string) error {
+	return fixSystemManagedFilePermissions(path)
 }
@@ -0,0 +1,120 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package logger provides the structured logging backend shared by the
+// Compute Engine Windows agents. Records are written as JSON lines, rotated
+// by size and age, so failures can be correlated after the fact instead of
+// disappearing into the Windows event log as flat strings.
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	logFileName = "gce-agent.log"
+	maxSizeMB   = 10
+	maxBackups  = 5
+	maxAgeDays  = 30
+)
+
+var (
+	setupOnce sync.Once
+	base      zerolog.Logger
+
+	debugMu sync.RWMutex
+	debug   bool
+)
+
+func setup() {
+	dir, err := logDir()
+	if err != nil || os.MkdirAll(dir, 0700) != nil {
+		// Nowhere better to report this than stderr.
+		base = zerolog.New(os.Stderr).With().Timestamp().Logger()
+		return
+	}
+	writer := &lumberjack.Logger{
+		Filename:   filepath.Join(dir, logFileName),
+		MaxSize:    maxSizeMB,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAgeDays,
+	}
+	base = zerolog.New(writer).With().Timestamp().Logger()
+}
+
+// SetDebug toggles whether Debug-level records are emitted. It's driven by
+// the enable-debug-logging metadata attribute.
+func SetDebug(enabled bool) {
+	debugMu.Lock()
+	defer debugMu.Unlock()
+	debug = enabled
+}
+
+func debugEnabled() bool {
+	debugMu.RLock()
+	defer debugMu.RUnlock()
+	return debug
+}
+
+// Logger wraps a zerolog context with fields already attached via With.
+type Logger struct {
+	ctx zerolog.Logger
+}
+
+// With returns a Logger with the given key/value pairs attached to every
+// subsequent record, e.g. logger.With("username", u, "key_fp", fp).
+func With(fields ...interface{}) *Logger {
+	setupOnce.Do(setup)
+	ctx := base.With()
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok {
+			continue
+		}
+		ctx = ctx.Interface(key, fields[i+1])
+	}
+	return &Logger{ctx: ctx.Logger()}
+}
+
+func (l *Logger) Info(format string, v ...interface{}) {
+	l.ctx.Info().Msg(fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warn(format string, v ...interface{}) {
+	l.ctx.Warn().Msg(fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Error(v ...interface{}) {
+	l.ctx.Error().Msg(fmt.Sprint(v...))
+}
+
+func (l *Logger) Debug(format string, v ...interface{}) {
+	if !debugEnabled() {
+		return
+	}
+	l.ctx.Debug().Msg(fmt.Sprintf(format, v...))
+}
+
+// Info, Warn, Error, and Debug are thin wrappers over a Logger with no
+// fields attached, kept so existing call sites don't need to change.
+func Info(format string, v ...interface{})  { With().Info(format, v...) }
+func Warn(format string, v ...interface{})  { With().Warn(format, v...) }
+func Error(v ...interface{})                { With().Error(v...) }
+func Debug(format string, v ...interface{}) { With().Debug(format, v...) }